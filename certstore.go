@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// certCacheCapacity bounds certStore's LRU the same way
+// transportCacheCapacity bounds ProxyResolver's transport cache (see
+// resolver.go): host comes straight from the CONNECT request's target,
+// so without a bound a client could mint an unbounded number of distinct
+// hosts and leak one generated leaf certificate per host forever.
+const certCacheCapacity = 1024
+
+// certStore generates and caches per-host TLS leaf certificates signed
+// by a configured CA, so MITM mode can terminate TLS for whatever host
+// a CONNECT request names without a certificate per site on disk. Leaf
+// certificates are evicted LRU-style past certCacheCapacity.
+type certStore struct {
+	caCert *x509.Certificate
+	caKey  *rsa.PrivateKey
+
+	mu    sync.Mutex
+	order *list.List
+	certs map[string]*list.Element
+}
+
+type certCacheEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+func newCertStore(caCert *x509.Certificate, caKey *rsa.PrivateKey) *certStore {
+	return &certStore{
+		caCert: caCert,
+		caKey:  caKey,
+		order:  list.New(),
+		certs:  make(map[string]*list.Element),
+	}
+}
+
+// loadCAFromFiles reads a PEM certificate/key pair to use as the MITM
+// signing CA. The key must be RSA, matching the leaf keys this store
+// generates.
+func loadCAFromFiles(certPath, keyPath string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading MITM CA: %w", err)
+	}
+
+	caCert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing MITM CA certificate: %w", err)
+	}
+
+	caKey, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("MITM CA key must be RSA")
+	}
+
+	return caCert, caKey, nil
+}
+
+// certificateFor returns a leaf certificate for host, generating and
+// caching a new one signed by the store's CA on first use.
+func (s *certStore) certificateFor(host string) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.certs[host]; ok {
+		s.order.MoveToFront(elem)
+		return elem.Value.(*certCacheEntry).cert, nil
+	}
+
+	cert, err := s.generateLeaf(host)
+	if err != nil {
+		return nil, err
+	}
+
+	elem := s.order.PushFront(&certCacheEntry{host: host, cert: cert})
+	s.certs[host] = elem
+
+	for s.order.Len() > certCacheCapacity {
+		oldest := s.order.Back()
+		if oldest == nil {
+			break
+		}
+		s.order.Remove(oldest)
+		delete(s.certs, oldest.Value.(*certCacheEntry).host)
+	}
+
+	return cert, nil
+}
+
+func (s *certStore) generateLeaf(host string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, &key.PublicKey, s.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing leaf certificate for %s: %w", host, err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, s.caCert.Raw},
+		PrivateKey:  key,
+	}, nil
+}
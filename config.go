@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the declarative policy file loaded via -config. It turns
+// govia from an open relay into something deployable: every target URL
+// is matched against Routes in order, and the first match's policy
+// decides whether the request is allowed, what auth it needs, and what
+// headers/rate limits apply.
+type Config struct {
+	Routes []RoutePolicy `yaml:"routes" json:"routes"`
+}
+
+// RoutePolicy is one entry of the config file. Match is a regular
+// expression tested against the target URL's host+path (e.g.
+// "^api\\.example\\.com/v1/").
+type RoutePolicy struct {
+	Match                string            `yaml:"match" json:"match"`
+	Allow                bool              `yaml:"allow" json:"allow"`
+	Auth                 *AuthRequirement  `yaml:"auth,omitempty" json:"auth,omitempty"`
+	InjectHeaders        map[string]string `yaml:"inject_headers,omitempty" json:"inject_headers,omitempty"`
+	SetResponseHeaders   map[string]string `yaml:"set_response_headers,omitempty" json:"set_response_headers,omitempty"`
+	StripResponseHeaders []string          `yaml:"strip_response_headers,omitempty" json:"strip_response_headers,omitempty"`
+	ProxySpec            string            `yaml:"proxy_spec,omitempty" json:"proxy_spec,omitempty"`
+	RateLimit            *RateLimitPolicy  `yaml:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+}
+
+// AuthRequirement describes the Authorization a matched route demands
+// before govia will fetch it.
+type AuthRequirement struct {
+	Type     string `yaml:"type" json:"type"` // "basic" or "bearer"
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+	Token    string `yaml:"token,omitempty" json:"token,omitempty"`
+}
+
+// Satisfied reports whether req carries the Authorization this
+// requirement demands.
+func (a *AuthRequirement) Satisfied(req *http.Request) bool {
+	return a.SatisfiedByHeader(req.Header.Get("Authorization"))
+}
+
+// SatisfiedByHeader reports whether an Authorization-style header value
+// satisfies this requirement. Factored out of Satisfied so CONNECT
+// tunnels, which carry credentials in Proxy-Authorization rather than
+// Authorization, can reuse the same check (see tunnel.go).
+func (a *AuthRequirement) SatisfiedByHeader(value string) bool {
+	switch a.Type {
+	case "basic":
+		username, password, ok := parseBasicAuthValue(value)
+		return ok && username == a.Username && password == a.Password
+	case "bearer":
+		return value == "Bearer "+a.Token
+	default:
+		return true
+	}
+}
+
+// parseBasicAuthValue decodes an Authorization/Proxy-Authorization
+// header value of the form "Basic <base64(user:pass)>", the way
+// (*http.Request).BasicAuth does for the Authorization header
+// specifically. The scheme is matched case-insensitively, since
+// net/http's BasicAuth does too (RFC 7235 auth-schemes are
+// case-insensitive).
+func parseBasicAuthValue(value string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(value) < len(prefix) || !strings.EqualFold(value[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(value[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
+
+// RateLimitPolicy configures a token-bucket limit, scoped either per
+// client IP or to the whole route.
+type RateLimitPolicy struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second" json:"requests_per_second"`
+	Burst             int     `yaml:"burst" json:"burst"`
+	Per               string  `yaml:"per" json:"per"` // "ip" (default) or "route"
+}
+
+// compiledRoute pairs a RoutePolicy with its compiled regex and, if
+// configured, its live rate limiter.
+type compiledRoute struct {
+	RoutePolicy
+	re      *regexp.Regexp
+	limiter *rateLimiter
+}
+
+// PolicyResolver matches target URLs against the routes loaded from a
+// config file.
+type PolicyResolver struct {
+	routes []*compiledRoute
+}
+
+// loadPolicyResolver reads and compiles the config file at path. YAML is
+// assumed unless path ends in ".json".
+func loadPolicyResolver(path string) (*PolicyResolver, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	var cfg Config
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, &cfg)
+	} else {
+		err = yaml.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+
+	resolver := &PolicyResolver{}
+	for _, route := range cfg.Routes {
+		re, err := regexp.Compile(route.Match)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", route.Match, err)
+		}
+
+		compiled := &compiledRoute{RoutePolicy: route, re: re}
+		if route.RateLimit != nil {
+			compiled.limiter = newRateLimiter(*route.RateLimit)
+		}
+		resolver.routes = append(resolver.routes, compiled)
+	}
+
+	return resolver, nil
+}
+
+// Match returns the first route whose pattern matches target's
+// host+path, in config-file order, or ok=false if none do.
+func (r *PolicyResolver) Match(target *url.URL) (*compiledRoute, bool) {
+	subject := target.Host + target.Path
+	for _, route := range r.routes {
+		if route.re.MatchString(subject) {
+			return route, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/andybalholm/brotli"
+)
+
+// hopByHopHeaders are connection-scoped headers that must not be
+// forwarded past a proxy hop, per RFC 7230 section 6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func stripHopByHopHeaders(header http.Header) {
+	for _, h := range hopByHopHeaders {
+		header.Del(h)
+	}
+}
+
+// decodingReader wraps body in the reader matching contentEncoding so
+// callers can rewrite the decoded content instead of running over
+// compressed bytes. An empty or unrecognised encoding returns body as-is.
+func decodingReader(body io.Reader, contentEncoding string) (io.Reader, error) {
+	switch contentEncoding {
+	case "gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return flate.NewReader(body), nil
+	case "br":
+		return brotli.NewReader(body), nil
+	case "":
+		return body, nil
+	default:
+		return nil, fmt.Errorf("unsupported content-encoding: %s", contentEncoding)
+	}
+}
@@ -1,101 +1,22 @@
 package main
 
 import (
-	"fmt"
+	"flag"
 	"io"
-	"net"
+	"log"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-func rewriteURLs(content, baseURL, proxyBase string) string {
-	parsedURL, err := url.Parse(baseURL)
-	if err != nil {
-		return content
-	}
-	baseHost := parsedURL.Scheme + "://" + parsedURL.Host
-
-	rewriteURL := func(originalURL string) string {
-		if strings.HasPrefix(originalURL, proxyBase+"/") ||
-		   strings.HasPrefix(originalURL, "data:") ||
-		   strings.HasPrefix(originalURL, "#") ||
-		   strings.HasPrefix(originalURL, "javascript:") ||
-		   strings.HasPrefix(originalURL, "mailto:") ||
-		   strings.HasPrefix(originalURL, "tel:") ||
-		   strings.HasPrefix(originalURL, "ftp:") ||
-		   originalURL == "" {
-			return originalURL
-		}
-
-		if strings.HasPrefix(originalURL, "http://") || strings.HasPrefix(originalURL, "https://") {
-			// Absolute URL - proxy it
-			return proxyBase + "/" + originalURL
-		} else if strings.HasPrefix(originalURL, "//") {
-			// Protocol-relative URL
-			return proxyBase + "/https:" + originalURL
-		} else if strings.HasPrefix(originalURL, "/") {
-			// Absolute path
-			return proxyBase + "/" + baseHost + originalURL
-		} else {
-			// Relative path - resolve relative to current path
-			basePath := parsedURL.Path
-			if basePath != "" && !strings.HasSuffix(basePath, "/") {
-				lastSlash := strings.LastIndex(basePath, "/")
-				if lastSlash >= 0 {
-					basePath = basePath[:lastSlash+1]
-				} else {
-					basePath = "/"
-				}
-			} else if basePath == "" {
-				basePath = "/"
-			}
-			resolvedURL := baseHost + basePath + originalURL
-			return proxyBase + "/" + resolvedURL
-		}
-	}
-
-	patterns := []struct {
-		regex    *regexp.Regexp
-		groupIdx int
-	}{
-		// HTML attributes: href="...", src="...", etc.
-		{regexp.MustCompile(`(href|src|action|data-src|data-url|data-href|data-original|data-lazy-src|poster|formaction)=["']([^"']+)["']`), 2},
-		// CSS url() declarations
-		{regexp.MustCompile(`url\(["']?([^"'\)]+)["']?\)`), 1},
-		// JavaScript strings that look like URLs
-		{regexp.MustCompile(`["']((?:https?:)?//[^"'\s]+)["']`), 1},
-		// Meta refresh URLs
-		{regexp.MustCompile(`url=([^"'\s>]+)`), 1},
-	}
-
-	result := content
-	for _, pattern := range patterns {
-		result = pattern.regex.ReplaceAllStringFunc(result, func(match string) string {
-			submatches := pattern.regex.FindStringSubmatch(match)
-			if len(submatches) > pattern.groupIdx {
-				originalURL := submatches[pattern.groupIdx]
-				rewrittenURL := rewriteURL(originalURL)
-				if rewrittenURL != originalURL {
-					return strings.Replace(match, originalURL, rewrittenURL, 1)
-				}
-			}
-			return match
-		})
-	}
-
-	return result
-}
-
 func handleRequest(ctx *gin.Context) {
 	path := ctx.Param("path")
 
 	if path == "/" {
 		ctx.IndentedJSON(http.StatusOK, gin.H{
-			"message": "CORS Proxy. Just go to /:url to use, or /proxy-spec/:url to use proxy. Supported proxy formats: host:port, username:password@host:port, host:port@username:password, host:username:password:port, username:password:host:port",
+			"message": "CORS Proxy. Just go to /:url to use, or /proxy-spec/:url to use proxy. Proxy spec is a scheme://[user:pass@]host:port URL (http, https, socks5 or socks5h), optionally comma-separated to chain multiple upstreams. If started with -config, targets are additionally subject to the configured route policies.",
 		})
 		ctx.Done()
 		return
@@ -104,6 +25,8 @@ func handleRequest(ctx *gin.Context) {
 	var requestedURL string
 	var proxySpec string
 
+	existingSessionID, existingSession := sessionFromRequest(ctx)
+
 	// Check if this is a proxied URL with proxy spec (format: /proxy:port/http... or /proxy:port/https...)
 	// Find the first occurrence of /http or /https
 	httpIndex := strings.Index(path, "/http")
@@ -123,69 +46,25 @@ func handleRequest(ctx *gin.Context) {
 		if strings.HasPrefix(path, "/http") || strings.HasPrefix(path, "/https") {
 			requestedURL = path[1:]
 		} else {
-			// This might be a relative URL from a previously proxied page
-			// Try to get the original host from Referer header
-			referer := ctx.Request.Header.Get("Referer")
-			if referer != "" {
-				// Extract the proxied URL from referer
-				// Referer will be like: http://localhost:5000/https://example.com/page
-				// or with proxy: http://localhost:5000/proxy:port/https://example.com/page
-				if strings.Contains(referer, "://"+ctx.Request.Host+"/") {
-					parts := strings.SplitN(referer, "/"+ctx.Request.Host+"/", 2)
-					if len(parts) == 2 {
-						refererPath := parts[1]
-						var baseURL string
-
-						// Check if referer path contains proxy spec
-						httpIndex := strings.Index(refererPath, "/http")
-						if httpIndex == -1 {
-							httpsIndex := strings.Index(refererPath, "/https")
-							if httpsIndex != -1 {
-								httpIndex = httpsIndex
-							}
-						}
-
-						if httpIndex > 0 {
-							// Referer has proxy spec, use it for this request too
-							proxySpec = refererPath[:httpIndex]
-							baseURL = refererPath[httpIndex+1:] // Remove leading slash
-						} else {
-							// Referer has direct URL
-							baseURL = refererPath
-						}
-
-						if strings.HasPrefix(baseURL, "http") {
-							// Resolve relative path against the base URL
-							parsedBase, err := url.Parse(baseURL)
-							if err == nil {
-								if strings.HasPrefix(path, "/") {
-									// Absolute path on the same host
-									requestedURL = parsedBase.Scheme + "://" + parsedBase.Host + path
-								} else {
-									// Relative path - resolve against current path
-									basePath := parsedBase.Path
-									if !strings.HasSuffix(basePath, "/") {
-										lastSlash := strings.LastIndex(basePath, "/")
-										if lastSlash >= 0 {
-											basePath = basePath[:lastSlash+1]
-										}
-									}
-									requestedURL = parsedBase.Scheme + "://" + parsedBase.Host + basePath + path
-								}
-							}
-						}
-					}
-				}
+			// This might be a relative URL from a previously proxied page.
+			// Resolve it against this client's most recently visited origin
+			// (see session.go's lastOrigin), rather than guessing from the
+			// Referer header.
+			var origin *url.URL
+			var ok bool
+			if existingSession != nil {
+				origin, proxySpec, ok = existingSession.lastOrigin()
 			}
-
-			if requestedURL == "" {
+			if !ok {
 				ctx.IndentedJSON(http.StatusBadRequest, gin.H{
-					"message": "Invalid URL or missing referer for relative path",
+					"message": "Invalid URL or missing session for relative path",
 				})
 				ctx.Done()
 				return
 			}
 
+			requestedURL = origin.Scheme + "://" + origin.Host + path
+
 			// Validate resolved URL
 			parsedURL, err := url.Parse(requestedURL)
 			if err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
@@ -208,11 +87,63 @@ func handleRequest(ctx *gin.Context) {
 		return
 	}
 
+	var policy *compiledRoute
+	if policies != nil {
+		matched, ok := policies.Match(parsedURL)
+		if !ok || !matched.Allow {
+			ctx.IndentedJSON(http.StatusForbidden, gin.H{
+				"message": "Target blocked by policy",
+			})
+			ctx.Done()
+			return
+		}
+
+		if matched.Auth != nil && !matched.Auth.Satisfied(ctx.Request) {
+			switch matched.Auth.Type {
+			case "basic":
+				ctx.Header("WWW-Authenticate", `Basic realm="govia"`)
+			case "bearer":
+				ctx.Header("WWW-Authenticate", `Bearer realm="govia"`)
+			}
+			ctx.IndentedJSON(http.StatusUnauthorized, gin.H{
+				"message": "Authorization required",
+			})
+			ctx.Done()
+			return
+		}
+
+		if matched.limiter != nil && !matched.limiter.Allow(ctx.ClientIP()) {
+			ctx.IndentedJSON(http.StatusTooManyRequests, gin.H{
+				"message": "Rate limit exceeded",
+			})
+			ctx.Done()
+			return
+		}
+
+		if matched.ProxySpec != "" {
+			proxySpec = matched.ProxySpec
+		}
+		policy = matched
+	}
+
+	sessionID, _, originSt := resolveSession(existingSessionID, existingSession, parsedURL, proxySpec)
+	ctx.SetCookie(sessionCookieName, signSessionID(sessionID), 0, "/", "", false, true)
+
 	req, _ := http.NewRequest(ctx.Request.Method, requestedURL, ctx.Request.Body)
 
 	req.Header = ctx.Request.Header.Clone()
 	req.Header.Del("origin")
 	req.Header.Del("referer")
+	// The browser's Cookie header holds cookies for govia's own domain
+	// (including govia_session); the target's cookies live in
+	// originSt.jar and are attached by http.Client instead.
+	req.Header.Del("cookie")
+
+	if policy != nil {
+		for k, v := range policy.InjectHeaders {
+			req.Header.Set(k, v)
+		}
+	}
 
 	queryValues := req.URL.Query()
 	for k, v := range ctx.Request.URL.Query() {
@@ -220,90 +151,15 @@ func handleRequest(ctx *gin.Context) {
 	}
 	req.URL.RawQuery = queryValues.Encode()
 
-	var client *http.Client
-	if proxySpec != "" {
-		var proxyURLStr string
-
-		// Support multiple proxy formats:
-		// 1. host:port (simple proxy)
-		// 2. username:password@host:port (standard)
-		// 3. host:port@username:password
-		// 4. host:username:password:port
-		// 5. username:password:host:port
-
-		if strings.Contains(proxySpec, "@") {
-			// Could be username:password@host:port or host:port@username:password
-			atIndex := strings.Index(proxySpec, "@")
-			beforeAt := proxySpec[:atIndex]
-			afterAt := proxySpec[atIndex+1:]
-
-			beforeParts := strings.Split(beforeAt, ":")
-			afterParts := strings.Split(afterAt, ":")
-
-			if len(beforeParts) == 2 && len(afterParts) == 2 {
-				// Could be either format, check which one makes sense
-				// If beforeAt looks like host:port and afterAt looks like username:password
-				if (strings.Contains(beforeParts[0], ".") || strings.Contains(beforeParts[0], "-") || net.ParseIP(beforeParts[0]) != nil) {
-					// Format: host:port@username:password
-					host, port := beforeParts[0], beforeParts[1]
-					username, password := afterParts[0], afterParts[1]
-					proxyURLStr = fmt.Sprintf("http://%s:%s@%s:%s", username, password, host, port)
-				} else {
-					// Format: username:password@host:port
-					username, password := beforeParts[0], beforeParts[1]
-					host, port := afterParts[0], afterParts[1]
-					proxyURLStr = fmt.Sprintf("http://%s:%s@%s:%s", username, password, host, port)
-				}
-			} else {
-				// Fallback to standard format
-				proxyURLStr = "http://" + proxySpec
-			}
-		} else {
-			parts := strings.Split(proxySpec, ":")
-			if len(parts) == 2 {
-				// Format: host:port
-				host, port := parts[0], parts[1]
-				proxyURLStr = fmt.Sprintf("http://%s:%s", host, port)
-			} else if len(parts) == 4 {
-				// Could be host:username:password:port or username:password:host:port
-				// Try to detect by checking if first part looks like IP/hostname
-				firstPart := parts[0]
-				if strings.Contains(firstPart, ".") || strings.Contains(firstPart, "-") || net.ParseIP(firstPart) != nil {
-					// Looks like host:username:password:port
-					host, username, password, port := parts[0], parts[1], parts[2], parts[3]
-					proxyURLStr = fmt.Sprintf("http://%s:%s@%s:%s", username, password, host, port)
-				} else {
-					// Looks like username:password:host:port
-					username, password, host, port := parts[0], parts[1], parts[2], parts[3]
-					proxyURLStr = fmt.Sprintf("http://%s:%s@%s:%s", username, password, host, port)
-				}
-			} else {
-				ctx.IndentedJSON(http.StatusBadRequest, gin.H{
-					"message": "Invalid proxy specification. Supported formats: host:port, username:password@host:port, host:port@username:password, host:username:password:port, or username:password:host:port",
-				})
-				ctx.Done()
-				return
-			}
-		}
-
-		proxyURL, err := url.Parse(proxyURLStr)
-		if err != nil {
-			ctx.IndentedJSON(http.StatusBadRequest, gin.H{
-				"message": "Invalid proxy specification",
-			})
-			ctx.Done()
-			return
-		}
-
-		transport := &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-		}
-		client = &http.Client{
-			Transport: transport,
-		}
-	} else {
-		client = http.DefaultClient
+	transport, err := proxyResolver.TransportFor(proxySpec)
+	if err != nil {
+		ctx.IndentedJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid proxy specification: " + err.Error(),
+		})
+		ctx.Done()
+		return
 	}
+	client := &http.Client{Transport: transport, Jar: originSt.jar}
 
 	response, err1 := client.Do(req)
 
@@ -314,28 +170,35 @@ func handleRequest(ctx *gin.Context) {
 		ctx.Done()
 		return
 	}
+	defer response.Body.Close()
+
+	// Add rather than ctx.Header's Set so a multi-valued header (notably
+	// Set-Cookie, both upstream's own and, here, the govia_session cookie
+	// ctx.SetCookie already wrote above) doesn't clobber the others.
+	for k, values := range response.Header.Clone() {
+		for _, v := range values {
+			ctx.Writer.Header().Add(k, v)
+		}
+	}
+	stripHopByHopHeaders(ctx.Writer.Header())
 
-	for k, v := range response.Header.Clone() {
-		ctx.Header(k, v[0])
+	if policy != nil {
+		for _, h := range policy.StripResponseHeaders {
+			ctx.Writer.Header().Del(h)
+		}
+		for k, v := range policy.SetResponseHeaders {
+			ctx.Header(k, v)
+		}
 	}
 
 	ctx.Header("Access-Control-Allow-Origin", "*")
 	ctx.Header("Access-Control-Allow-Methods", "*")
 	ctx.Header("Access-Control-Allow-Headers", "*")
 
-	responseBytes, err2 := io.ReadAll(response.Body)
-
-	if err2 != nil {
-		ctx.IndentedJSON(http.StatusInternalServerError, gin.H{
-			"message": "Failed to read response: " + err2.Error(),
-		})
-		ctx.Done()
-		return
-	}
-
 	// Check if response contains text content that might have URLs and rewrite them
 	contentType := strings.ToLower(response.Header.Get("Content-Type"))
-	shouldRewrite := strings.Contains(contentType, "text/html") ||
+	isHTML := strings.Contains(contentType, "text/html")
+	shouldRewrite := isHTML ||
 					 strings.Contains(contentType, "text/css") ||
 					 strings.Contains(contentType, "application/javascript") ||
 					 strings.Contains(contentType, "application/x-javascript") ||
@@ -344,17 +207,86 @@ func handleRequest(ctx *gin.Context) {
 					 strings.Contains(contentType, "application/xml") ||
 					 strings.Contains(contentType, "text/plain")
 
-	if shouldRewrite {
-		proxyBase := "http://" + ctx.Request.Host
-		contentStr := string(responseBytes)
-		rewrittenContent := rewriteURLs(contentStr, requestedURL, proxyBase)
-		responseBytes = []byte(rewrittenContent)
+	if shouldRewrite && response.ContentLength > maxRewriteBodyBytes {
+		shouldRewrite = false
+		ctx.Header("X-Govia-Rewrite-Skipped", "body-too-large")
+	}
+
+	if !shouldRewrite {
+		ctx.Status(response.StatusCode)
+		io.Copy(ctx.Writer, response.Body)
+		return
+	}
+
+	contentEncoding := strings.ToLower(response.Header.Get("Content-Encoding"))
+	bodyReader, err := decodingReader(response.Body, contentEncoding)
+	if err != nil {
+		ctx.IndentedJSON(http.StatusInternalServerError, gin.H{
+			"message": "Failed to decode response: " + err.Error(),
+		})
+		ctx.Done()
+		return
+	}
+
+	if contentEncoding != "" {
+		ctx.Writer.Header().Del("Content-Encoding")
 	}
+	ctx.Writer.Header().Del("Content-Length")
 
-	ctx.Data(response.StatusCode, response.Header.Get("Content-Type"), responseBytes)
+	proxyBase := "http://" + ctx.Request.Host
+	ctx.Status(response.StatusCode)
+	if isHTML {
+		streamRewriteURLs(bodyReader, ctx.Writer, requestedURL, proxyBase)
+	} else {
+		streamRewriteNonHTMLText(bodyReader, ctx.Writer, requestedURL, proxyBase)
+	}
 }
 
+// connectProxy, when set, is a ProxyResolver spec (e.g.
+// "socks5://host:1080") that CONNECT tunnels are chained through
+// instead of dialing the target directly.
+var connectProxy string
+
+// mitmStore is non-nil when MITM mode is enabled, i.e. a CA cert/key
+// pair was supplied so CONNECT tunnels can be terminated and their
+// requests rewritten instead of opaquely forwarded.
+var mitmStore *certStore
+
+// proxyResolver builds and caches the upstream proxy chains used for
+// both regular requests (via proxySpec) and CONNECT tunnels (via
+// connectProxy).
+var proxyResolver = NewProxyResolver()
+
+// policies holds the routes loaded from -config, or nil when no config
+// file was given, in which case govia behaves as the open relay it's
+// always been.
+var policies *PolicyResolver
+
 func main() {
+	connectProxyFlag := flag.String("connect-proxy", "", "upstream proxy spec (e.g. socks5://host:1080) to chain CONNECT tunnels through")
+	mitmCACert := flag.String("mitm-ca-cert", "", "PEM CA certificate used to sign per-host leaf certs for MITM mode")
+	mitmCAKey := flag.String("mitm-ca-key", "", "PEM CA private key matching -mitm-ca-cert")
+	configPath := flag.String("config", "", "YAML or JSON policy file restricting which targets may be proxied (see config.go)")
+	flag.Parse()
+
+	connectProxy = *connectProxyFlag
+
+	if *mitmCACert != "" && *mitmCAKey != "" {
+		caCert, caKey, err := loadCAFromFiles(*mitmCACert, *mitmCAKey)
+		if err != nil {
+			log.Fatalf("govia: %v", err)
+		}
+		mitmStore = newCertStore(caCert, caKey)
+	}
+
+	if *configPath != "" {
+		resolver, err := loadPolicyResolver(*configPath)
+		if err != nil {
+			log.Fatalf("govia: %v", err)
+		}
+		policies = resolver
+	}
+
 	router := gin.Default()
 
 	router.GET("*path", handleRequest)
@@ -365,5 +297,16 @@ func main() {
 	router.OPTIONS("*path", handleRequest)
 	router.HEAD("*path", handleRequest)
 
-	router.Run(":5000")
+	server := &http.Server{
+		Addr: ":5000",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodConnect {
+				handleConnect(w, r, router)
+				return
+			}
+			router.ServeHTTP(w, r)
+		}),
+	}
+
+	log.Fatal(server.ListenAndServe())
 }
\ No newline at end of file
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// ipLimiterCacheCapacity bounds a per-IP rateLimiter's cache the same
+// way sessionStoreCapacity bounds the session store (see session.go):
+// clientIP can be influenced by the caller (e.g. via X-Forwarded-For),
+// so without a bound a caller could mint unbounded distinct "IPs" and
+// leak one *rate.Limiter per IP forever.
+const ipLimiterCacheCapacity = 4096
+
+// rateLimiter enforces a RateLimitPolicy's token bucket, either as one
+// shared bucket for the whole route ("route") or as one bucket per
+// client IP ("ip", the default), created lazily the first time that IP
+// is seen and evicted LRU-style once the cache fills.
+type rateLimiter struct {
+	spec RateLimitPolicy
+
+	route *rate.Limiter
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type ipLimiterEntry struct {
+	ip      string
+	limiter *rate.Limiter
+}
+
+func newRateLimiter(spec RateLimitPolicy) *rateLimiter {
+	rl := &rateLimiter{spec: spec}
+	if spec.Per == "route" {
+		rl.route = rate.NewLimiter(rate.Limit(spec.RequestsPerSecond), spec.Burst)
+	} else {
+		rl.order = list.New()
+		rl.entries = make(map[string]*list.Element)
+	}
+	return rl
+}
+
+// Allow reports whether a request from clientIP may proceed, consuming
+// a token from the relevant bucket if so.
+func (rl *rateLimiter) Allow(clientIP string) bool {
+	if rl.route != nil {
+		return rl.route.Allow()
+	}
+
+	rl.mu.Lock()
+	limiter := rl.limiterFor(clientIP)
+	rl.mu.Unlock()
+
+	return limiter.Allow()
+}
+
+// limiterFor returns clientIP's limiter, creating one and evicting the
+// least recently used entry past ipLimiterCacheCapacity if needed.
+// Callers must hold rl.mu.
+func (rl *rateLimiter) limiterFor(clientIP string) *rate.Limiter {
+	if elem, ok := rl.entries[clientIP]; ok {
+		rl.order.MoveToFront(elem)
+		return elem.Value.(*ipLimiterEntry).limiter
+	}
+
+	limiter := rate.NewLimiter(rate.Limit(rl.spec.RequestsPerSecond), rl.spec.Burst)
+	elem := rl.order.PushFront(&ipLimiterEntry{ip: clientIP, limiter: limiter})
+	rl.entries[clientIP] = elem
+
+	for rl.order.Len() > ipLimiterCacheCapacity {
+		oldest := rl.order.Back()
+		if oldest == nil {
+			break
+		}
+		rl.order.Remove(oldest)
+		delete(rl.entries, oldest.Value.(*ipLimiterEntry).ip)
+	}
+
+	return limiter
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// atomsToAttrs maps each element that can carry a URL to the exact
+// attributes on it that hold one. Only these tag/attribute pairs are
+// rewritten; everything else (including JS string literals that merely
+// look like URLs) passes through untouched.
+var atomsToAttrs = map[atom.Atom]map[string]bool{
+	atom.A:          {"href": true},
+	atom.Img:        {"src": true, "srcset": true},
+	atom.Form:       {"action": true},
+	atom.Video:      {"src": true, "poster": true},
+	atom.Audio:      {"src": true},
+	atom.Source:     {"src": true, "srcset": true},
+	atom.Iframe:     {"src": true},
+	atom.Base:       {"href": true},
+	atom.Blockquote: {"cite": true},
+	atom.Object:     {"data": true},
+	atom.Applet:     {"codebase": true},
+	atom.Body:       {"background": true},
+	atom.Button:     {"formaction": true},
+	atom.Input:      {"formaction": true},
+	atom.Link:       {"href": true},
+	atom.Script:     {"src": true},
+}
+
+var (
+	// cssURLPattern matches url(...) quote-agnostically (RE2 has no
+	// backreferences, so it can't require the closing quote to match the
+	// opening one); rewriteCSSURLs strips a matching pair itself once
+	// it has the captured inner text.
+	cssURLPattern         = regexp.MustCompile(`url\(\s*([^)]*?)\s*\)`)
+	metaRefreshURLPattern = regexp.MustCompile(`(?i)(url\s*=\s*)(.+)$`)
+
+	// quotedAbsoluteURLPattern catches bare absolute URL literals in
+	// non-HTML text (JS, XML, plain text) that rewriteNonHTMLText rewrites
+	// since there's no HTML structure to walk for those content types.
+	quotedAbsoluteURLPattern = regexp.MustCompile(`(["'])((?:https?:)?//[^"'\s]+)(["'])`)
+)
+
+// bufWriterPool reuses the bufio.Writer that buffers rewritten tokens
+// before they're flushed downstream, keeping per-request allocations
+// bounded when many responses are being rewritten concurrently.
+var bufWriterPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewWriterSize(io.Discard, 32*1024)
+	},
+}
+
+// rewriteURLs walks content as HTML, rewriting only the URL-bearing
+// attributes listed in atomsToAttrs (plus srcset, meta-refresh and CSS
+// url() values), and re-serialises each token through html.Token.String
+// rather than doing string replacement, so existing HTML escaping is
+// preserved. Any <base href> encountered during the walk becomes the
+// base for resolving subsequent relative URLs.
+func rewriteURLs(content, baseURL, proxyBase string) string {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return content
+	}
+
+	var out bytes.Buffer
+	if err := rewriteHTMLStream(strings.NewReader(content), &out, base, proxyBase, 0); err != nil {
+		return content
+	}
+	return out.String()
+}
+
+// rewriteHTMLStream is the token-at-a-time core shared by rewriteURLs
+// and the streaming response path (see stream.go). It writes rewritten
+// tokens to dst as they're produced, flushing to dst (and, if dst is an
+// http.Flusher, over the wire) every flushEvery bytes; flushEvery <= 0
+// means "only flush once, at the end".
+func rewriteHTMLStream(src io.Reader, dst io.Writer, base *url.URL, proxyBase string, flushEvery int) error {
+	z := html.NewTokenizer(src)
+
+	bw := bufWriterPool.Get().(*bufio.Writer)
+	bw.Reset(dst)
+	defer func() {
+		bw.Reset(io.Discard)
+		bufWriterPool.Put(bw)
+	}()
+
+	inStyle := false
+	pending := 0
+
+	for {
+		if z.Next() == html.ErrorToken {
+			if err := z.Err(); err != nil && err != io.EOF {
+				return err
+			}
+			break
+		}
+
+		tok := z.Token()
+
+		switch tok.Type {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			rewriteAttrs(&tok, base, proxyBase)
+			if tok.DataAtom == atom.Base {
+				if href := attrValue(tok.Attr, "href"); href != "" {
+					if resolved, err := base.Parse(href); err == nil {
+						base = resolved
+					}
+				}
+			}
+			if tok.DataAtom == atom.Style {
+				inStyle = tok.Type == html.StartTagToken
+			}
+		case html.EndTagToken:
+			if tok.DataAtom == atom.Style {
+				inStyle = false
+			}
+		case html.TextToken:
+			if inStyle {
+				tok.Data = rewriteCSSURLs(tok.Data, base, proxyBase)
+			}
+		}
+
+		str := tok.String()
+		if _, err := bw.WriteString(str); err != nil {
+			return err
+		}
+		pending += len(str)
+
+		if flushEvery > 0 && pending >= flushEvery {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			if f, ok := dst.(http.Flusher); ok {
+				f.Flush()
+			}
+			pending = 0
+		}
+	}
+
+	return bw.Flush()
+}
+
+// rewriteAttrs rewrites the URL-bearing attributes of a single token in
+// place, dispatching to the srcset and CSS passes where those apply.
+func rewriteAttrs(tok *html.Token, base *url.URL, proxyBase string) {
+	if tok.DataAtom == atom.Meta {
+		rewriteMetaRefresh(tok, base, proxyBase)
+	}
+
+	urlAttrs := atomsToAttrs[tok.DataAtom]
+
+	for i := range tok.Attr {
+		attr := &tok.Attr[i]
+		switch attr.Key {
+		case "style":
+			attr.Val = rewriteCSSURLs(attr.Val, base, proxyBase)
+		case "srcset":
+			if urlAttrs["srcset"] {
+				attr.Val = rewriteSrcset(attr.Val, base, proxyBase)
+			}
+		default:
+			if urlAttrs[attr.Key] {
+				attr.Val = rewriteSingleURL(attr.Val, base, proxyBase)
+			}
+		}
+	}
+}
+
+// rewriteMetaRefresh rewrites the target of <meta http-equiv="refresh"
+// content="0; url=...">, leaving the delay portion untouched. The URL
+// itself may or may not be quoted (content="5;url='https://example.com'"
+// is common in the wild), so a quoted value's matching quote is stripped
+// before parsing and restored after, the same way rewriteCSSURLs handles
+// url(...)'s optional quoting.
+func rewriteMetaRefresh(tok *html.Token, base *url.URL, proxyBase string) {
+	if !strings.EqualFold(attrValue(tok.Attr, "http-equiv"), "refresh") {
+		return
+	}
+
+	for i := range tok.Attr {
+		if tok.Attr[i].Key != "content" {
+			continue
+		}
+		tok.Attr[i].Val = metaRefreshURLPattern.ReplaceAllStringFunc(tok.Attr[i].Val, func(match string) string {
+			groups := metaRefreshURLPattern.FindStringSubmatch(match)
+			prefix, raw := groups[1], strings.TrimSpace(groups[2])
+
+			quote, rawURL := "", raw
+			if len(raw) >= 2 && (raw[0] == '\'' || raw[0] == '"') {
+				if end := strings.IndexByte(raw[1:], raw[0]); end != -1 {
+					quote = string(raw[0])
+					rawURL = raw[1 : end+1]
+				}
+			} else if end := strings.IndexAny(raw, "; \t"); end != -1 {
+				rawURL = raw[:end]
+			}
+
+			return prefix + quote + rewriteSingleURL(rawURL, base, proxyBase) + quote
+		})
+	}
+}
+
+// rewriteSrcset rewrites the URL in each comma-separated "url descriptor"
+// candidate of a srcset attribute, leaving descriptors untouched.
+func rewriteSrcset(value string, base *url.URL, proxyBase string) string {
+	candidates := strings.Split(value, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		fields[0] = rewriteSingleURL(fields[0], base, proxyBase)
+		candidates[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ",")
+}
+
+// rewriteCSSURLs rewrites every url(...) reference in a CSS fragment,
+// used for both <style> element bodies and inline style="" attributes.
+func rewriteCSSURLs(content string, base *url.URL, proxyBase string) string {
+	return cssURLPattern.ReplaceAllStringFunc(content, func(match string) string {
+		groups := cssURLPattern.FindStringSubmatch(match)
+		inner := groups[1]
+
+		quote := ""
+		if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+			quote = string(inner[0])
+			inner = inner[1 : len(inner)-1]
+		}
+
+		return "url(" + quote + rewriteSingleURL(inner, base, proxyBase) + quote + ")"
+	})
+}
+
+// rewriteNonHTMLText rewrites proxied URLs in a response body that's
+// textual but has no HTML structure for rewriteHTMLStream to walk (CSS,
+// JavaScript, XML, plain text): CSS url(...) references and bare quoted
+// absolute URL literals are rewritten in place.
+func rewriteNonHTMLText(content string, base *url.URL, proxyBase string) string {
+	content = rewriteCSSURLs(content, base, proxyBase)
+	return quotedAbsoluteURLPattern.ReplaceAllStringFunc(content, func(match string) string {
+		groups := quotedAbsoluteURLPattern.FindStringSubmatch(match)
+		return groups[1] + rewriteSingleURL(groups[2], base, proxyBase) + groups[3]
+	})
+}
+
+// rewriteSingleURL resolves originalURL against base and, unless it's a
+// scheme the proxy shouldn't touch (data:, javascript:, an already-proxied
+// URL, ...), rewrites it to route back through the proxy.
+func rewriteSingleURL(originalURL string, base *url.URL, proxyBase string) string {
+	trimmed := strings.TrimSpace(originalURL)
+	if trimmed == "" ||
+		strings.HasPrefix(trimmed, proxyBase+"/") ||
+		strings.HasPrefix(trimmed, "data:") ||
+		strings.HasPrefix(trimmed, "#") ||
+		strings.HasPrefix(trimmed, "javascript:") ||
+		strings.HasPrefix(trimmed, "mailto:") ||
+		strings.HasPrefix(trimmed, "tel:") ||
+		strings.HasPrefix(trimmed, "ftp:") {
+		return originalURL
+	}
+
+	resolved, err := base.Parse(trimmed)
+	if err != nil {
+		return originalURL
+	}
+
+	return proxyBase + "/" + resolved.String()
+}
+
+func attrValue(attrs []html.Attribute, key string) string {
+	for _, a := range attrs {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
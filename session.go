@@ -0,0 +1,259 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionCookieName is the cookie govia sets on a client's first request
+// so later requests for bare, unrewritten paths (e.g. a runtime
+// fetch('/favicon.ico')) can be resolved against an origin this client
+// has already visited, instead of guessing from the Referer header.
+const sessionCookieName = "govia_session"
+
+// sessionStoreCapacity bounds the LRU so long-running processes don't
+// accumulate state for every client ever seen.
+const sessionStoreCapacity = 1024
+
+// originCacheCapacity bounds a session's origins LRU the same way
+// sessionStoreCapacity bounds the session store: a client holding one
+// valid session cookie could otherwise visit an unbounded number of
+// distinct origins and accumulate one originState+cookie jar per origin
+// forever.
+const originCacheCapacity = 64
+
+// session is one client's state, keyed by its signed govia_session
+// cookie. A client may have several proxied origins open at once (e.g.
+// two browser tabs sharing the one cookie), so state is kept per origin
+// rather than as a single mutable field: navigating to a new origin in
+// one tab must not clobber another tab's in-flight origin or its cookie
+// jar. Origins are evicted LRU-style past originCacheCapacity.
+type session struct {
+	mu      sync.Mutex
+	order   *list.List
+	origins map[string]*list.Element
+	last    *url.URL
+}
+
+// originState is a client's state for a single proxied origin: the
+// upstream proxy chain it was last reached through, and the cookie jar
+// replaying that origin's own Set-Cookie headers back to it on later
+// requests.
+type originState struct {
+	proxySpec string
+	jar       http.CookieJar
+}
+
+type originEntry struct {
+	key   string
+	state *originState
+}
+
+func newSession() *session {
+	return &session{
+		order:   list.New(),
+		origins: make(map[string]*list.Element),
+	}
+}
+
+// stateFor returns the client's state for origin's scheme+host, creating
+// one with a fresh cookie jar on first visit and evicting the least
+// recently used origin past originCacheCapacity if needed. It also
+// records origin as the client's most recently resolved one, for
+// lastOrigin to fall back to.
+func (s *session) stateFor(origin *url.URL, proxySpec string) *originState {
+	base := &url.URL{Scheme: origin.Scheme, Host: origin.Host}
+	key := base.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var state *originState
+	if elem, ok := s.origins[key]; ok {
+		s.order.MoveToFront(elem)
+		state = elem.Value.(*originEntry).state
+	} else {
+		jar, _ := cookiejar.New(nil)
+		state = &originState{jar: jar}
+		elem := s.order.PushFront(&originEntry{key: key, state: state})
+		s.origins[key] = elem
+
+		for s.order.Len() > originCacheCapacity {
+			oldest := s.order.Back()
+			if oldest == nil {
+				break
+			}
+			s.order.Remove(oldest)
+			delete(s.origins, oldest.Value.(*originEntry).key)
+		}
+	}
+
+	state.proxySpec = proxySpec
+	s.last = base
+	return state
+}
+
+// lastOrigin returns the client's most recently resolved origin and the
+// proxy spec it was last reached through. This is the best-effort guess
+// used to resolve a bare relative path (e.g. fetch('/api/data')), which
+// carries no origin information of its own; it can still pick the wrong
+// tab's origin when several are proxied concurrently, but unlike a
+// single shared origin field it never overwrites another origin's
+// already-accumulated cookie jar.
+func (s *session) lastOrigin() (*url.URL, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last == nil {
+		return nil, "", false
+	}
+	elem, ok := s.origins[s.last.String()]
+	if !ok {
+		return nil, "", false
+	}
+	state := elem.Value.(*originEntry).state
+	return s.last, state.proxySpec, true
+}
+
+// sessionStore is a small LRU of session, keyed by signed session ID.
+type sessionStore struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type sessionStoreEntry struct {
+	id      string
+	session *session
+}
+
+func newSessionStore(capacity int) *sessionStore {
+	return &sessionStore{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (s *sessionStore) get(id string) (*session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[id]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(elem)
+	return elem.Value.(*sessionStoreEntry).session, true
+}
+
+func (s *sessionStore) put(id string, sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[id]; ok {
+		elem.Value.(*sessionStoreEntry).session = sess
+		s.order.MoveToFront(elem)
+		return
+	}
+
+	elem := s.order.PushFront(&sessionStoreEntry{id: id, session: sess})
+	s.entries[id] = elem
+
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		if oldest == nil {
+			break
+		}
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*sessionStoreEntry).id)
+	}
+}
+
+var sessions = newSessionStore(sessionStoreCapacity)
+
+// sessionSigningKey authenticates session cookies so a client can't
+// forge a session ID to splice itself into another session's jar. It's
+// generated fresh per process, which is sufficient since sessions never
+// outlive the process anyway (see sessionStore's in-memory LRU).
+var sessionSigningKey = newSigningKey()
+
+func newSigningKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("govia: failed to generate session signing key: " + err.Error())
+	}
+	return key
+}
+
+func newSessionID() string {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		panic("govia: failed to generate session ID: " + err.Error())
+	}
+	return hex.EncodeToString(raw)
+}
+
+func signSessionID(id string) string {
+	mac := hmac.New(sha256.New, sessionSigningKey)
+	mac.Write([]byte(id))
+	return id + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifySessionCookie(value string) (string, bool) {
+	id, _, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+	if !hmac.Equal([]byte(value), []byte(signSessionID(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+// sessionFromRequest looks up the session named by the request's
+// govia_session cookie, if any, verifying its signature first.
+func sessionFromRequest(ctx *gin.Context) (string, *session) {
+	value, err := ctx.Cookie(sessionCookieName)
+	if err != nil || value == "" {
+		return "", nil
+	}
+
+	id, ok := verifySessionCookie(value)
+	if !ok {
+		return "", nil
+	}
+
+	sess, ok := sessions.get(id)
+	if !ok {
+		return "", nil
+	}
+	return id, sess
+}
+
+// resolveSession returns the client session named by existingID,
+// starting a fresh one if there wasn't one, and resolves that session's
+// state for origin. It returns the session's ID so the caller can (re)set
+// the cookie.
+func resolveSession(existingID string, existing *session, origin *url.URL, proxySpec string) (string, *session, *originState) {
+	id, sess := existingID, existing
+	if sess == nil {
+		sess = newSession()
+		id = newSessionID()
+	}
+
+	state := sess.stateFor(origin, proxySpec)
+	sessions.put(id, sess)
+	return id, sess, state
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net/url"
+)
+
+// flushEveryBytes controls how often the streaming rewriter flushes
+// buffered output to the client while a response is still arriving from
+// upstream, so a large page starts rendering before it's fully fetched.
+const flushEveryBytes = 32 * 1024
+
+// maxRewriteBodyBytes is the response size above which rewriting is
+// skipped in favour of an unmodified streaming passthrough. Rewriting
+// means walking the whole document as HTML, which stops being worth it
+// once the body is large enough that the walk itself is the bottleneck.
+const maxRewriteBodyBytes = 8 * 1024 * 1024
+
+// streamRewriteURLs is the streaming counterpart to rewriteURLs: it
+// reads HTML from src and writes the rewritten result to dst as tokens
+// are produced, instead of buffering the whole body in memory first.
+func streamRewriteURLs(src io.Reader, dst io.Writer, baseURL, proxyBase string) error {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		_, copyErr := io.Copy(dst, src)
+		return copyErr
+	}
+
+	return rewriteHTMLStream(src, dst, base, proxyBase, flushEveryBytes)
+}
+
+// streamRewriteNonHTMLText rewrites a non-HTML textual response (CSS,
+// JavaScript, XML, plain text): these have no HTML structure for the
+// tokenizer to walk, so unlike streamRewriteURLs this reads the whole
+// body before rewriting it with rewriteNonHTMLText. The caller's
+// maxRewriteBodyBytes check against the response's declared
+// Content-Length isn't a reliable bound here (it's -1 for chunked
+// responses, and reflects the pre-decode size under Content-Encoding),
+// so src is read through an io.LimitReader to cap the decoded bytes
+// actually buffered; a body that turns out larger than the cap is
+// passed through unrewritten instead.
+func streamRewriteNonHTMLText(src io.Reader, dst io.Writer, baseURL, proxyBase string) error {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		_, copyErr := io.Copy(dst, src)
+		return copyErr
+	}
+
+	content, err := io.ReadAll(io.LimitReader(src, maxRewriteBodyBytes+1))
+	if err != nil {
+		return err
+	}
+
+	if len(content) > maxRewriteBodyBytes {
+		if _, err := dst.Write(content); err != nil {
+			return err
+		}
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	_, err = io.WriteString(dst, rewriteNonHTMLText(string(content), base, proxyBase))
+	return err
+}
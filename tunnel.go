@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// handleConnect implements the HTTP CONNECT method so govia can be set
+// as a browser's configured proxy directly, rather than only being hit
+// as /https://.... Without MITM enabled it just tunnels bytes between
+// the client and the target in both directions. With MITM enabled (see
+// certstore.go) it instead terminates TLS using a generated leaf
+// certificate and feeds the decrypted requests back through router, so
+// HTTPS pages get the same rewriting pipeline as any other proxied URL.
+func handleConnect(w http.ResponseWriter, r *http.Request, router http.Handler) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+
+	targetHost := r.URL.Host
+	if !strings.Contains(targetHost, ":") {
+		targetHost += ":443"
+	}
+
+	// A plain (non-MITM) CONNECT tunnel is otherwise invisible to the
+	// policy engine: once established it's a raw byte pipe, so this is
+	// the only point a policy check can happen. With MITM enabled,
+	// decrypted requests go back through router/handleRequest below,
+	// which already runs the full host+path policy check on the real
+	// request; matching here too would only have the bare host (the
+	// path is still encrypted at CONNECT time) and could wrongly reject
+	// a path-scoped allow rule before MITM ever sees the real path, so
+	// it's skipped in that case.
+	if policies != nil && mitmStore == nil {
+		target := &url.URL{Scheme: "https", Host: targetHost}
+		matched, ok := policies.Match(target)
+		if !ok || !matched.Allow {
+			clientConn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+			return
+		}
+
+		if matched.Auth != nil && !matched.Auth.SatisfiedByHeader(r.Header.Get("Proxy-Authorization")) {
+			clientConn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"govia\"\r\n\r\n"))
+			return
+		}
+
+		if matched.limiter != nil && !matched.limiter.Allow(clientIPFromRemoteAddr(r.RemoteAddr)) {
+			clientConn.Write([]byte("HTTP/1.1 429 Too Many Requests\r\n\r\n"))
+			return
+		}
+	}
+
+	if mitmStore != nil {
+		if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			return
+		}
+		serveMITM(clientConn, targetHost, router)
+		return
+	}
+
+	upstreamConn, err := dialConnectTarget(targetHost)
+	if err != nil {
+		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer upstreamConn.Close()
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	tunnel(clientConn, upstreamConn)
+}
+
+// dialConnectTarget dials targetHost directly, or through connectProxy
+// (a ProxyResolver spec) when one is configured.
+func dialConnectTarget(targetHost string) (net.Conn, error) {
+	if connectProxy == "" {
+		return net.Dial("tcp", targetHost)
+	}
+
+	dialer, err := proxyResolver.DialerFor(connectProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialer.Dial("tcp", targetHost)
+}
+
+// tunnel copies bytes between two connections until either side closes.
+func tunnel(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+	}()
+
+	wg.Wait()
+}
+
+// serveMITM terminates TLS for host over conn using a freshly generated
+// leaf certificate, then serves decrypted HTTP requests on it by
+// rewriting each request's path into govia's own /<scheme>://host/path
+// convention and dispatching it through router, exactly like a normal
+// proxied request.
+func serveMITM(conn net.Conn, host string, router http.Handler) {
+	leaf, err := mitmStore.certificateFor(hostOnly(host))
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*leaf}})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL.Scheme = "https"
+		req.URL.Host = host
+		req.URL.Path = "/https://" + host + req.URL.Path
+		router.ServeHTTP(w, req)
+	})
+
+	listener := newSingleConnListener(tlsConn)
+	server := &http.Server{
+		Handler: handler,
+		// The single connection's lifetime IS the listener's lifetime:
+		// without this, Accept's second call blocks on l.done forever
+		// once the one connection is done, and http.Server.Serve (hence
+		// this call, hence the CONNECT-handling goroutine) never returns.
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+	server.Serve(listener)
+}
+
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// clientIPFromRemoteAddr extracts the bare IP from a net.Conn-style
+// RemoteAddr ("ip:port"), for rate-limiting CONNECT requests the same
+// way ctx.ClientIP() does for ordinary ones.
+func clientIPFromRemoteAddr(remoteAddr string) string {
+	return hostOnly(remoteAddr)
+}
+
+// singleConnListener adapts a single already-accepted net.Conn into a
+// net.Listener so the standard http.Server machinery (request parsing,
+// keep-alive, response framing) can serve it like any other connection.
+type singleConnListener struct {
+	conn     net.Conn
+	accepted bool
+	done     chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, done: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *singleConnListener) Close() error {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return l.conn.Close()
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}